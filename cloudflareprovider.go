@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const cloudflareAPIBase = "https://api.cloudflare.com/client/v4"
+
+// cloudflareProvider reconciles records against Cloudflare's DNS API, for
+// users who are not on AWS. Authentication is via an API token read from the
+// CLOUDFLARE_API_TOKEN environment variable.
+type cloudflareProvider struct {
+	log    *zap.Logger
+	token  string
+	client *http.Client
+}
+
+func newCloudflareProvider(log *zap.Logger) (*cloudflareProvider, error) {
+	token := os.Getenv("CLOUDFLARE_API_TOKEN")
+	if token == "" {
+		return nil, errors.New("CLOUDFLARE_API_TOKEN must be set to use the cloudflare provider")
+	}
+	return &cloudflareProvider{log: log, token: token, client: http.DefaultClient}, nil
+}
+
+type cfResponse struct {
+	Success bool            `json:"success"`
+	Errors  []cfAPIError    `json:"errors"`
+	Result  json.RawMessage `json:"result"`
+}
+
+type cfAPIError struct {
+	Message string `json:"message"`
+}
+
+type cfZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type cfRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int64  `json:"ttl"`
+}
+
+func (p *cloudflareProvider) do(ctx context.Context, method, path string, body interface{}) (*cfResponse, error) {
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPIBase+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var out cfResponse
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("unable to parse cloudflare response: %v", err)
+	}
+	if !out.Success {
+		return nil, fmt.Errorf("cloudflare api error: %v", out.Errors)
+	}
+	return &out, nil
+}
+
+// findZone walks up the labels of host (a.b.example.com. -> b.example.com. ->
+// example.com.) until it finds a zone Cloudflare knows about, same strategy
+// as route53Provider's longest-suffix zone match.
+func (p *cloudflareProvider) findZone(ctx context.Context, host string) (*cfZone, error) {
+
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+
+	for i := 0; i < len(labels)-1; i++ {
+		name := strings.Join(labels[i:], ".")
+
+		resp, err := p.do(ctx, http.MethodGet, "/zones?name="+name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var zones []cfZone
+		if err := json.Unmarshal(resp.Result, &zones); err != nil {
+			return nil, err
+		}
+		if len(zones) > 0 {
+			return &zones[0], nil
+		}
+	}
+
+	return nil, fmt.Errorf("unable to find a cloudflare zone for %s", host)
+}
+
+func (p *cloudflareProvider) findRecord(ctx context.Context, zoneID, host, rtype string) (*cfRecord, error) {
+
+	path := fmt.Sprintf("/zones/%s/dns_records?type=%s&name=%s", zoneID, rtype, strings.TrimSuffix(host, "."))
+
+	resp, err := p.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []cfRecord
+	if err := json.Unmarshal(resp.Result, &records); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return &records[0], nil
+}
+
+// Resolve satisfies the Provider interface.
+func (p *cloudflareProvider) Resolve(ctx context.Context, host, rtype string) (string, error) {
+
+	zone, err := p.findZone(ctx, host)
+	if err != nil {
+		return "", err
+	}
+
+	record, err := p.findRecord(ctx, zone.ID, host, rtype)
+	if err != nil {
+		return "", err
+	}
+	if record == nil {
+		return "", nil
+	}
+	return record.Content, nil
+}
+
+// Upsert satisfies the Provider interface. Cloudflare isn't a batchFlusher -
+// the change is applied inline, so the returned done channel already holds
+// the outcome by the time Upsert returns.
+func (p *cloudflareProvider) Upsert(ctx context.Context, host, rtype, value string, ttl int64) (<-chan error, error) {
+
+	zone, err := p.findZone(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := p.findRecord(ctx, zone.ID, host, rtype)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := cfRecord{
+		Type:    rtype,
+		Name:    strings.TrimSuffix(host, "."),
+		Content: value,
+		TTL:     ttl,
+	}
+
+	if record == nil {
+		_, err = p.do(ctx, http.MethodPost, fmt.Sprintf("/zones/%s/dns_records", zone.ID), payload)
+		return immediate(err), nil
+	}
+
+	_, err = p.do(ctx, http.MethodPut, fmt.Sprintf("/zones/%s/dns_records/%s", zone.ID, record.ID), payload)
+	return immediate(err), nil
+}
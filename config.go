@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigEntry describes a single DNS record that update53 should reconcile.
+// When no -config file is supplied, main synthesizes a single ConfigEntry
+// from the -hostname/-forceip/-getip/-hostedzone flags.
+type ConfigEntry struct {
+	Hostname   string `yaml:"hostname"`
+	HostedZone string `yaml:"hostedzone,omitempty"`
+	Type       string `yaml:"type,omitempty"` // A (default) or AAAA
+	TTL        int64  `yaml:"ttl,omitempty"`
+	ForceIP    string `yaml:"forceip,omitempty"`
+	GetIP      string `yaml:"getip,omitempty"`
+	Iface      string `yaml:"iface,omitempty"`
+	Provider   string `yaml:"provider,omitempty"` // route53 or cloudflare (rfc2136 is recognised but fails to build); empty uses -provider, otherwise overrides it for this entry
+}
+
+// Config is the top level structure loaded from a -config yaml/json file.
+type Config struct {
+	Entries []ConfigEntry `yaml:"entries"`
+}
+
+// loadConfig reads and parses the config file at path. JSON is valid YAML so
+// the same decoder handles both "-config foo.yml" and "-config foo.json".
+func loadConfig(path string) (*Config, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %v", err)
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s: %v", path, err)
+	}
+
+	if len(cfg.Entries) == 0 {
+		return nil, fmt.Errorf("config file %s contains no entries", path)
+	}
+
+	for i, e := range cfg.Entries {
+		if e.Hostname == "" {
+			return nil, fmt.Errorf("config file %s: entry %d is missing a hostname", path, i)
+		}
+		if e.Type != "" && e.Type != "A" && e.Type != "AAAA" {
+			return nil, fmt.Errorf("config file %s: entry %d has unsupported type %q (only A and AAAA are supported)", path, i, e.Type)
+		}
+	}
+
+	return cfg, nil
+}
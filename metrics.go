@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	updatesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "update53_updates_total",
+		Help: "Total number of reconcile attempts, by result (ok, error or nochange).",
+	}, []string{"result"})
+
+	lastSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "update53_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last tick that succeeded or reported no change.",
+	})
+
+	providerCallLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "update53_provider_call_duration_seconds",
+		Help: "Latency of provider Upsert and Flush calls, by provider and result.",
+	}, []string{"provider", "result"})
+
+	cachedIP = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "update53_cached_ip",
+		Help: "The ip currently cached for a hostname/type, exposed as a label.",
+	}, []string{"hostname", "type", "ip"})
+
+	cachedIPMu     sync.Mutex
+	cachedIPLabels = make(map[string]string) // hostname|type -> ip currently exported, so the old series can be removed
+)
+
+// setCachedIP updates the update53_cached_ip gauge, removing the series for
+// any previous ip so a changing address doesn't leave stale label sets behind.
+func setCachedIP(hostname, rtype, ip string) {
+
+	cachedIPMu.Lock()
+	defer cachedIPMu.Unlock()
+
+	key := hostname + "|" + rtype
+	if old, ok := cachedIPLabels[key]; ok && old != ip {
+		cachedIP.DeleteLabelValues(hostname, rtype, old)
+	}
+	cachedIPLabels[key] = ip
+	cachedIP.WithLabelValues(hostname, rtype, ip).Set(1)
+}
+
+// recordTick stores the outcome of the most recent tick so healthzHandler can
+// decide whether the daemon is still making progress.
+func (u53 *update53) recordTick(ok bool) {
+
+	u53.healthMu.Lock()
+	defer u53.healthMu.Unlock()
+
+	u53.lastTickAt = time.Now()
+	u53.lastTickOK = ok
+
+	if ok {
+		lastSuccessTimestamp.Set(float64(u53.lastTickAt.Unix()))
+	}
+}
+
+// healthzHandler returns 200 iff the most recent tick succeeded or reported
+// no change within 2x tickInterval, so Kubernetes/ECS liveness probes can
+// restart a daemon that has stopped making progress.
+func (u53 *update53) healthzHandler(tickInterval time.Duration) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		u53.healthMu.Lock()
+		lastTickAt := u53.lastTickAt
+		lastTickOK := u53.lastTickOK
+		u53.healthMu.Unlock()
+
+		if lastTickOK && time.Since(lastTickAt) < 2*tickInterval {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("ok\n"))
+			return
+		}
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("stale\n"))
+	}
+}
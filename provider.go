@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Provider is implemented by each DNS backend update53 knows how to
+// reconcile records against. The main loop, IP detection, change-detection
+// cache and signal handling are all provider agnostic; only Provider
+// implementations talk to a specific DNS API.
+type Provider interface {
+	// Resolve returns the record's current value, or "" if it does not exist.
+	Resolve(ctx context.Context, host, rtype string) (string, error)
+	// Upsert creates or updates host/rtype to point at value with the given
+	// ttl. err reports a failure to even queue the change (e.g. the hosted
+	// zone couldn't be resolved); callers must not treat err == nil as the
+	// change having been applied. Instead they must wait on the returned
+	// done channel, which carries the real outcome (nil on success): a
+	// provider that talks to its backend inline resolves it before Upsert
+	// returns, while a batchFlusher provider only resolves it once a
+	// subsequent Flush has actually talked to the API.
+	Upsert(ctx context.Context, host, rtype, value string, ttl int64) (done <-chan error, err error)
+}
+
+// zoneHinter is an optional extension to Provider implemented by backends
+// that can accept an explicit zone/domain id to skip auto-detecting it, e.g.
+// route53Provider honouring the -hostedzone flag/config field. Its done
+// channel carries the same meaning as Provider.Upsert's.
+type zoneHinter interface {
+	UpsertInZone(ctx context.Context, zone, host, rtype, value string, ttl int64) (done <-chan error, err error)
+}
+
+// batchFlusher is an optional extension to Provider implemented by backends
+// that queue up their Upsert calls instead of sending them straight away and
+// need a single flush once every entry in a tick has been reconciled, e.g.
+// route53Provider batching every change destined for the same hosted zone
+// into one ChangeResourceRecordSets call.
+type batchFlusher interface {
+	Flush(ctx context.Context) error
+}
+
+// immediate wraps err in an already-resolved done channel, for providers
+// that apply an Upsert inline rather than batching it for a later Flush.
+func immediate(err error) <-chan error {
+	done := make(chan error, 1)
+	done <- err
+	return done
+}
+
+// newProvider builds the Provider named by name. zoneCacheTTL is only used by
+// providers that need to cache a zone lookup (currently route53). ctx bounds
+// any setup calls the provider makes (e.g. loading AWS credentials).
+func newProvider(ctx context.Context, name string, log *zap.Logger, zoneCacheTTL time.Duration) (Provider, error) {
+	switch name {
+	case "", "route53":
+		return newRoute53Provider(ctx, log, zoneCacheTTL)
+	case "cloudflare":
+		return newCloudflareProvider(log)
+	case "rfc2136":
+		return nil, fmt.Errorf("provider rfc2136 is not implemented yet")
+	default:
+		return nil, fmt.Errorf("unknown provider: %s (want route53 or cloudflare)", name)
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"go.uber.org/zap"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
 )
 
 // PublicIP wraps data on a public ip address
@@ -18,8 +21,15 @@ type PublicIP struct {
 }
 
 // getPublicIP reads the instance public ip from metadata or returns the force ip
-// is it has been supplied or tries to get the ip from the supplied url.
-func GetPublicIP(ip, geturl string) chan *PublicIP {
+// is it has been supplied or tries to get the ip from the supplied url. When
+// ipv6 is true the IPv6 address is looked up (metadata key "public-ipv6" or an
+// IPv6-only HTTP call) instead of the default IPv4 address. If iface is set the
+// address is read from that local network interface instead, skipping
+// link-local/ULA/RFC1918 addresses unless allowPrivate is set. log is used so
+// the goroutine's messages can be correlated with the caller that spawned it,
+// and ctx is threaded down so a signal-driven shutdown cancels any in-flight
+// HTTP/metadata call promptly.
+func GetPublicIP(ctx context.Context, log *zap.Logger, ip, geturl, iface string, ipv6, allowPrivate bool) chan *PublicIP {
 
 	c := make(chan *PublicIP)
 
@@ -33,10 +43,15 @@ func GetPublicIP(ip, geturl string) chan *PublicIP {
 		if ip == "" {
 			// get our external ip address so we can add it to the results
 
-			if geturl != "" {
-				ip, err = getFromURL(geturl)
+			if iface != "" {
+				log.Debug("fetching public ip from interface", zap.String("iface", iface), zap.Bool("ipv6", ipv6))
+				ip, err = getFromInterface(iface, ipv6, allowPrivate)
+			} else if geturl != "" {
+				log.Debug("fetching public ip from url", zap.String("url", geturl), zap.Bool("ipv6", ipv6))
+				ip, err = getFromURL(ctx, geturl, ipv6)
 			} else {
-				ip, err = getFromMetadata()
+				log.Debug("fetching public ip from ec2 metadata", zap.Bool("ipv6", ipv6))
+				ip, err = getFromMetadata(ctx, ipv6)
 			}
 		}
 		if err != nil {
@@ -44,37 +59,132 @@ func GetPublicIP(ip, geturl string) chan *PublicIP {
 			return
 		}
 
-		if x := net.ParseIP(ip); x == nil {
+		x := net.ParseIP(ip)
+		if x == nil {
 			c <- &PublicIP{ip: "", e: fmt.Errorf("unable to parse public ip from: %s", ip)}
-		} else {
-			c <- &PublicIP{ip: ip, e: nil}
+			return
+		}
+
+		if ipv6 {
+			if x.To4() != nil || x.To16() == nil {
+				c <- &PublicIP{ip: "", e: fmt.Errorf("expected an ipv6 address but got: %s", ip)}
+				return
+			}
+		} else if x.To4() == nil {
+			c <- &PublicIP{ip: "", e: fmt.Errorf("expected an ipv4 address but got: %s", ip)}
+			return
 		}
+
+		c <- &PublicIP{ip: ip, e: nil}
 	}()
 	return c
 }
 
-func getFromMetadata() (string, error) {
-	md := ec2metadata.New(session.New())
-	return md.GetMetadata("public-ipv4")
+func getFromMetadata(ctx context.Context, ipv6 bool) (string, error) {
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to load aws config: %v", err)
+	}
+
+	client := imds.NewFromConfig(cfg)
+
+	path := "public-ipv4"
+	if ipv6 {
+		path = "public-ipv6"
+	}
+
+	resp, err := client.GetMetadata(ctx, &imds.GetMetadataInput{Path: path})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Content.Close()
+
+	data, err := ioutil.ReadAll(resp.Content)
+	if err != nil {
+		return "", fmt.Errorf("unable to read metadata response: %v", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
 }
 
-func getFromURL(url string) (string, error) {
+func getFromURL(ctx context.Context, url string, ipv6 bool) (string, error) {
+
+	client := http.DefaultClient
+	if ipv6 {
+		// force the dial onto the ipv6 stack so a dual-stack host still gets
+		// its v6 address back
+		client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "tcp6", addr)
+				},
+			},
+		}
+	}
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to build request for: %s error: %v", url, err)
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("unable to get public ip details from: %s error: %v", url, err)
 	}
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return "", fmt.Errorf("unable to read public ip in response: %v", err)
 	}
-	resp.Body.Close()
 
 	return strings.TrimSpace(string(body)), nil
 
 }
 
+// getFromInterface returns the first address of the requested family
+// configured on the named local interface, skipping link-local/ULA/RFC1918
+// addresses unless allowPrivate is set. Useful on non-EC2 hosts behind a
+// router that hands the host a routable address directly, e.g. IPv6 or
+// WireGuard endpoints.
+func getFromInterface(name string, ipv6, allowPrivate bool) (string, error) {
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("unable to find interface %s: %v", name, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("unable to read addresses for interface %s: %v", name, err)
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		x := ipnet.IP
+		if ipv6 {
+			if x.To4() != nil || x.To16() == nil {
+				continue
+			}
+		} else if x.To4() == nil {
+			continue
+		}
+
+		if !allowPrivate && (x.IsLinkLocalUnicast() || x.IsLinkLocalMulticast() || x.IsPrivate()) {
+			continue
+		}
+
+		return x.String(), nil
+	}
+
+	return "", fmt.Errorf("interface %s has no usable address", name)
+}
+
 /*
 
  */
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// route53Provider reconciles records against an AWS Route53 account. Hosted
+// zone lookups are cached across every entry sharing the provider; see
+// lookupZoneCache. Upsert calls are queued rather than sent immediately so
+// that every entry destined for the same hosted zone in a tick can be folded
+// into a single ChangeResourceRecordSets call via Flush.
+type route53Provider struct {
+	log *zap.Logger
+	svc *route53.Client
+
+	zoneCacheTTL time.Duration
+
+	zoneMu    sync.Mutex
+	zoneCache map[string]zoneCacheEntry
+
+	pendingMu sync.Mutex
+	pending   map[string][]pendingChange // hosted zone id -> queued changes, drained by Flush
+}
+
+// pendingChange is a single Upsert queued against a hosted zone. done is
+// sent the real outcome of change once Flush has issued (or failed to
+// issue) the ChangeResourceRecordSets call for that zone.
+type pendingChange struct {
+	change types.Change
+	done   chan error
+}
+
+// zoneCacheEntry is a single cached hosted-zone-name -> hosted zone id mapping.
+type zoneCacheEntry struct {
+	id      string
+	expires time.Time
+}
+
+func newRoute53Provider(ctx context.Context, log *zap.Logger, zoneCacheTTL time.Duration) (*route53Provider, error) {
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load aws config: %v", err)
+	}
+
+	return &route53Provider{
+		log:          log,
+		svc:          route53.NewFromConfig(cfg),
+		zoneCacheTTL: zoneCacheTTL,
+		zoneCache:    make(map[string]zoneCacheEntry),
+		pending:      make(map[string][]pendingChange),
+	}, nil
+}
+
+// Resolve satisfies the Provider interface's signature only: it does not
+// query Route53 and always returns "" with a nil error, whether or not the
+// record exists. update53 keeps its own change-detection cache and does not
+// call Resolve.
+func (p *route53Provider) Resolve(ctx context.Context, host, rtype string) (string, error) {
+	return "", nil
+}
+
+// Upsert satisfies the Provider interface, auto-detecting the hosted zone.
+func (p *route53Provider) Upsert(ctx context.Context, host, rtype, value string, ttl int64) (<-chan error, error) {
+	return p.upsert(ctx, host, "", rtype, value, ttl)
+}
+
+// UpsertInZone satisfies the zoneHinter interface so callers that already
+// know the hosted zone id (the -hostedzone flag/config field) can skip
+// auto-detection entirely.
+func (p *route53Provider) UpsertInZone(ctx context.Context, zone, host, rtype, value string, ttl int64) (<-chan error, error) {
+	return p.upsert(ctx, host, zone, rtype, value, ttl)
+}
+
+// upsert resolves the hosted zone for host and queues the change against it.
+// Nothing is sent to AWS until Flush batches every queued change for the
+// zone into a single ChangeResourceRecordSets call, so that N entries
+// sharing a hosted zone in one tick cost one API call instead of N. The
+// returned channel only receives once Flush has actually issued (or failed
+// to issue) that zone's batch.
+func (p *route53Provider) upsert(ctx context.Context, host, zone, rtype, value string, ttl int64) (<-chan error, error) {
+
+	hzID, err := p.getHostedZoneID(ctx, host, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	change := pendingChange{
+		change: types.Change{
+			Action: types.ChangeActionUpsert,
+			ResourceRecordSet: &types.ResourceRecordSet{
+				Name: aws.String(host),
+				Type: types.RRType(rtype),
+				ResourceRecords: []types.ResourceRecord{
+					{Value: aws.String(value)},
+				},
+				TTL: aws.Int64(ttl),
+			},
+		},
+		done: make(chan error, 1),
+	}
+
+	p.pendingMu.Lock()
+	p.pending[hzID] = append(p.pending[hzID], change)
+	p.pendingMu.Unlock()
+
+	return change.done, nil
+}
+
+// Flush satisfies the batchFlusher interface. It drains every change queued
+// by upsert since the last Flush and issues one ChangeResourceRecordSets
+// call per hosted zone, then reports that zone's result back on every
+// queued change's done channel. Zones are flushed independently so that a
+// failure in one zone doesn't stop the others from being applied; if any
+// zone fails, the first error encountered is returned.
+func (p *route53Provider) Flush(ctx context.Context) error {
+
+	p.pendingMu.Lock()
+	batches := p.pending
+	p.pending = make(map[string][]pendingChange)
+	p.pendingMu.Unlock()
+
+	var firstErr error
+	for hzID, changes := range batches {
+		awsChanges := make([]types.Change, len(changes))
+		for i, c := range changes {
+			awsChanges[i] = c.change
+		}
+
+		_, err := p.svc.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+			ChangeBatch: &types.ChangeBatch{
+				Changes: awsChanges,
+				Comment: aws.String("Update53"),
+			},
+			HostedZoneId: aws.String(hzID),
+		})
+		if err != nil {
+			p.log.Warn("error flushing batched changes for hosted zone", zap.String("hostedzone", hzID), zap.Error(err))
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		for _, c := range changes {
+			c.done <- err
+		}
+	}
+
+	return firstErr
+}
+
+// getHostedZoneID gets the data from AWS so route53 can be updated. Results
+// are cached in p.zoneCache, keyed by hosted zone name, for p.zoneCacheTTL,
+// so that entries sharing a zone only pay for ListHostedZones once per TTL.
+func (p *route53Provider) getHostedZoneID(ctx context.Context, hostname, hz string) (string, error) {
+
+	if hz != "" {
+		return hz, nil
+	}
+
+	if id, ok := p.lookupZoneCache(hostname); ok {
+		return id, nil
+	}
+
+	// nothing unexpired in the cache so refresh it from AWS
+	zones, err := p.listHostedZones(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	expires := time.Now().Add(p.zoneCacheTTL)
+
+	p.zoneMu.Lock()
+	for name, id := range zones {
+		p.zoneCache[name] = zoneCacheEntry{id: id, expires: expires}
+	}
+	p.zoneMu.Unlock()
+
+	id, ok := p.lookupZoneCache(hostname)
+	if !ok {
+		return "", errors.New("unable to find hosted domain details")
+	}
+
+	return id, nil
+}
+
+// lookupZoneCache returns the hosted zone id cached against the longest
+// hostname suffix that matches hostname, ignoring entries that have expired.
+// e.g. "a.b.example.com." prefers a cached "b.example.com." over "example.com."
+func (p *route53Provider) lookupZoneCache(hostname string) (string, bool) {
+
+	p.zoneMu.Lock()
+	defer p.zoneMu.Unlock()
+
+	now := time.Now()
+	var bestSuffix, bestID string
+
+	for suffix, entry := range p.zoneCache {
+		if now.After(entry.expires) {
+			continue
+		}
+		matches := hostname == suffix || strings.HasSuffix(hostname, "."+suffix)
+		if matches && len(suffix) > len(bestSuffix) {
+			bestSuffix, bestID = suffix, entry.id
+		}
+	}
+
+	if bestSuffix == "" {
+		return "", false
+	}
+	return bestID, true
+}
+
+// listHostedZones pages through every hosted zone in the account, returning
+// a map of zone name to zone id.
+func (p *route53Provider) listHostedZones(ctx context.Context) (map[string]string, error) {
+
+	zones := make(map[string]string)
+
+	input := &route53.ListHostedZonesInput{}
+	for {
+		resp, err := p.svc.ListHostedZones(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, z := range resp.HostedZones {
+			zones[aws.ToString(z.Name)] = aws.ToString(z.Id)
+		}
+
+		if !resp.IsTruncated {
+			break
+		}
+		input.Marker = resp.NextMarker
+	}
+
+	return zones, nil
+}
@@ -1,226 +1,484 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
-type futureAns struct {
-	e error  // any error encountered while producing the data
-	s string // data to be returned
-}
+// tickInterval is how often the daemon reconciles its entries, and the unit
+// healthzHandler uses to decide whether the daemon has stalled.
+const tickInterval = time.Minute * 5
 
 type update53 struct {
-	previousip string // previous ip so we don't update every timer tick
-	forceip    string // use this ip for the update
-	getip      string // get the public ip from this url
-	hostname   string // update this hostname
-	hostedzone string // use this hosted zone id if known. saves a call to AWS
-	daemon     bool   // run as a daeon & update every 5 minutes
-	verbose    bool   // print status info
-	debug      bool   // print extra debug info
+	forceip      string // use this ip for the update
+	getip        string // get the public ip from this url
+	hostname     string // update this hostname
+	hostedzone   string // use this hosted zone id if known. saves a call to AWS
+	config       string // path to a yaml/json config file describing multiple entries
+	ipv6         bool   // update an AAAA record instead of an A record
+	ttl          int64  // ttl to set on the record
+	daemon       bool   // run as a daeon & update every 5 minutes
+	logFormat    string // json or console
+	logLevel     string // debug, info, warn or error
+	providerName string // default DNS provider: route53 or cloudflare (rfc2136 is recognised but newProvider returns an error for it)
+	listen       string // optional address to expose /metrics and /healthz on, e.g. :9153
+	iface        string // read the address from this local network interface instead of forceip/getip/metadata
+	allowPrivate bool   // allow an address read from -iface to be link-local/ULA/RFC1918
+
+	zoneCacheTTL time.Duration // how long a provider's hosted zone lookup is cached for
+
+	entries []ConfigEntry // entries to reconcile each tick, either from -config or synthesized from the flags above
+
+	log *zap.Logger // structured logger, built once from -log-format/-log-level
+
+	providersMu sync.Mutex
+	providers   map[string]Provider // lazily built, keyed by provider name, shared across entries
+
+	previousipsMu sync.Mutex
+	previousips   map[string]string // previous ip per (hostname, type) so we don't update every timer tick, guarded by previousipsMu since reconcileEntry runs one goroutine per entry
+
+	healthMu   sync.Mutex
+	lastTickAt time.Time // when updateAll last finished
+	lastTickOK bool      // whether that tick succeeded or reported no change
 }
 
 // main is the application start point
 func main() {
 
-	u53 := &update53{}
+	u53 := &update53{
+		providers:   make(map[string]Provider),
+		previousips: make(map[string]string),
+	}
 
 	// Flags are set during testing but env used during lambda runs
 	flag.StringVar(&u53.forceip, "forceip", "", "Use this ip instead of real ip")
 	flag.StringVar(&u53.getip, "getip", "", "get the public ip from this url")
 	flag.StringVar(&u53.hostname, "hostname", "", "Hostname to update")
 	flag.StringVar(&u53.hostedzone, "hostedzone", "", "HostedZone ID if known")
+	flag.StringVar(&u53.config, "config", "", "Path to a yaml/json config file describing multiple hostnames to reconcile")
+	flag.BoolVar(&u53.ipv6, "ipv6", false, "update an AAAA record with the host's ipv6 address instead of an A record")
+	flag.Int64Var(&u53.ttl, "ttl", 300, "ttl to set on the updated record")
 	flag.BoolVar(&u53.daemon, "daemon", false, "run as a daemon & check every 5 minutes")
-	flag.BoolVar(&u53.verbose, "verbose", false, "display status info")
-	flag.BoolVar(&u53.debug, "debug", false, "produce extra output")
+	flag.StringVar(&u53.logFormat, "log-format", "console", "log output format: json or console")
+	flag.StringVar(&u53.logLevel, "log-level", "info", "log level: debug, info, warn or error")
+	flag.StringVar(&u53.providerName, "provider", "route53", "DNS provider to reconcile records against: route53 or cloudflare")
+	flag.DurationVar(&u53.zoneCacheTTL, "zone-cache-ttl", time.Hour, "how long to cache a provider's hostname to hosted zone lookup table")
+	flag.StringVar(&u53.listen, "listen", "", "optional address to expose /metrics and /healthz on, e.g. :9153")
+	flag.StringVar(&u53.iface, "iface", "", "read the address from this local network interface instead of -forceip/-getip/EC2 metadata, e.g. eth0")
+	flag.BoolVar(&u53.allowPrivate, "allow-private", false, "allow an address read from -iface to be link-local/ULA/RFC1918")
 	flag.Parse()
 
-	if u53.debug == true {
-		u53.verbose = true
+	logger, err := newLogger(u53.logFormat, u53.logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error - %v\n", err)
+		os.Exit(1)
 	}
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+	u53.log = logger
 
 	if u53.forceip != "" && u53.getip != "" {
-		log.Printf("error - can not supply both -forceip and -getip\n")
-		os.Exit(1)
+		u53.log.Fatal("can not supply both -forceip and -getip")
+	}
+
+	if u53.config != "" {
+		cfg, err := loadConfig(u53.config)
+		if err != nil {
+			u53.log.Fatal("unable to load config", zap.Error(err))
+		}
+		u53.entries = cfg.Entries
+	} else {
+		if u53.hostname == "" {
+			u53.log.Fatal("must supply either -hostname or -config")
+		}
+		// synthesize a single entry so the rest of the pipeline only ever
+		// deals with the config-file shape
+		rtype := "A"
+		if u53.ipv6 {
+			rtype = "AAAA"
+		}
+		u53.entries = []ConfigEntry{
+			{
+				Hostname:   u53.hostname,
+				HostedZone: u53.hostedzone,
+				ForceIP:    u53.forceip,
+				GetIP:      u53.getip,
+				Iface:      u53.iface,
+				Type:       rtype,
+				TTL:        u53.ttl,
+			},
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := u53.providerFor(ctx, u53.providerName); err != nil {
+		u53.log.Fatal("unable to initialise provider", zap.String("provider", u53.providerName), zap.Error(err))
+	}
+
+	if u53.listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("/healthz", u53.healthzHandler(tickInterval))
+
+		srv := &http.Server{Addr: u53.listen, Handler: mux}
+		go func() {
+			u53.log.Info("starting metrics listener", zap.String("addr", u53.listen))
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				u53.log.Error("metrics listener exited", zap.Error(err))
+			}
+		}()
 	}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
 	// create time tick channel
-	tickChan := time.NewTicker(time.Minute * 5).C
+	tickChan := time.NewTicker(tickInterval).C
 	errChan := make(chan error)
 
 	// do initial update which will cause a result on the errChan
-	go u53.updatehostname(errChan)
+	go u53.updateAll(ctx, errChan)
 
 	dowhile := true
 	for dowhile == true {
 		select {
 		case <-tickChan:
-			// send off i am alive message to AWS
-			if u53.debug {
-				log.Printf("debug - tick Chan triggered\n")
-			}
-			go u53.updatehostname(errChan)
+			// send off i am alive message to the provider
+			u53.log.Debug("tick channel triggered")
+			go u53.updateAll(ctx, errChan)
 		case err := <-errChan:
 			if err != nil {
-				log.Printf("warning - error updating route53: %v\n", err)
+				u53.log.Warn("error updating dns provider", zap.Error(err))
 			}
 		case s := <-sig:
 			// done channel closed so exit the select and shutdown the seeder
-			if u53.verbose {
-				log.Println("\nShutting down on signal:", s)
-			}
+			u53.log.Info("shutting down on signal", zap.String("signal", s.String()))
+			cancel()
 			dowhile = false
 		}
 		if u53.daemon == false {
 			dowhile = false
 		}
 	}
-	if u53.verbose {
-		log.Println("Program Exiting")
+	u53.log.Info("program exiting")
+}
+
+// newLogger builds the zap.Logger used for the lifetime of the process.
+// format selects "json" (for Lambda/CloudWatch/container log pipelines) or
+// "console" (the human-friendly default); level is one of zapcore's level
+// names (debug, info, warn, error, ...).
+func newLogger(format, level string) (*zap.Logger, error) {
+
+	var zlvl zapcore.Level
+	if err := zlvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %v", level, err)
+	}
+
+	var cfg zap.Config
+	if format == "json" {
+		cfg = zap.NewProductionConfig()
+	} else {
+		cfg = zap.NewDevelopmentConfig()
 	}
+	cfg.Level = zap.NewAtomicLevelAt(zlvl)
+
+	return cfg.Build()
 }
 
-// updateHostname runs in a goroutine and will update route53 with a new ip if it has changed
-// any errors will be returned in the errChan
-func (u53 *update53) updatehostname(errChan chan error) {
+// providerFor returns the Provider for name, building and caching it on
+// first use. An empty name returns the default provider (-provider).
+func (u53 *update53) providerFor(ctx context.Context, name string) (Provider, error) {
 
-	if u53.hostname == "" {
-		errChan <- errors.New("invalid hostname supplied")
-		return
+	if name == "" {
+		name = u53.providerName
 	}
 
-	if !strings.HasSuffix(u53.hostname, ".") {
-		u53.hostname = u53.hostname + "."
+	u53.providersMu.Lock()
+	defer u53.providersMu.Unlock()
+
+	if p, ok := u53.providers[name]; ok {
+		return p, nil
 	}
 
-	if u53.forceip != "" {
-		if x := net.ParseIP(u53.forceip); x == nil {
-			errChan <- fmt.Errorf("invalid force ip supplied: %s", u53.forceip)
-			return
-		}
+	p, err := newProvider(ctx, name, u53.log, u53.zoneCacheTTL)
+	if err != nil {
+		return nil, err
 	}
 
-	sess := session.New()
-	r53svc := route53.New(sess)
+	u53.providers[name] = p
+	return p, nil
+}
 
-	// fill the channels with future answers to our questions
-	ipChan := GetPublicIP(u53.forceip, u53.getip)
+// updateAll reconciles every configured entry concurrently against its
+// provider, then flushes any provider that batches its changes, and only
+// then commits each entry's result (ip cache, metrics). This ordering
+// matters: a batchFlusher provider doesn't actually talk to its backend
+// until Flush is called, so committing earlier would mark a record as
+// up to date before Flush has confirmed the change was applied. The first
+// error encountered, or nil, is sent on errChan. ctx is cancelled when the
+// process receives a shutdown signal.
+func (u53 *update53) updateAll(ctx context.Context, errChan chan error) {
+
+	type entryResult struct {
+		outcome reconcileOutcome
+		err     error
+	}
 
-	// block until the answers become available
-	publicIP := <-ipChan
+	resChan := make(chan entryResult, len(u53.entries))
 
-	if publicIP.e != nil {
-		errChan <- publicIP.e
-		return
+	var wg sync.WaitGroup
+	for _, entry := range u53.entries {
+		wg.Add(1)
+		go func(entry ConfigEntry) {
+			defer wg.Done()
+			outcome, err := u53.reconcileEntry(ctx, entry)
+			resChan <- entryResult{outcome: outcome, err: err}
+		}(entry)
 	}
 
-	if u53.previousip == publicIP.ip {
-		// ip has not changed so no need to do anything else
-		if u53.verbose {
-			log.Printf("info - public ip has not changed so not updating\n")
+	go func() {
+		wg.Wait()
+		close(resChan)
+	}()
+
+	var firstErr error
+	var pending []reconcileOutcome
+	for r := range resChan {
+		if r.err != nil {
+			u53.log.Warn("error reconciling entry", zap.Error(r.err))
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		if r.outcome.done != nil {
+			pending = append(pending, r.outcome)
 		}
-		return
-	}
-
-	// if we need to update route53 then we need the hosted zone id
-	hzIDChan := getHostedZoneID(r53svc, u53.hostname, u53.hostedzone)
-	hzID := <-hzIDChan
-
-	if hzID.e != nil {
-		errChan <- hzID.e
-		return
-	}
-
-	params := &route53.ChangeResourceRecordSetsInput{
-		ChangeBatch: &route53.ChangeBatch{
-			Changes: []*route53.Change{
-				{
-					Action: aws.String("UPSERT"),
-					ResourceRecordSet: &route53.ResourceRecordSet{
-						Name: aws.String(u53.hostname), // host we want to update
-						Type: aws.String("A"),
-						ResourceRecords: []*route53.ResourceRecord{
-							{ // set the new ip address
-								Value: aws.String(publicIP.ip),
-							},
-						},
-						TTL: aws.Int64(300),
-					},
-				},
-			},
-			Comment: aws.String("Update53"),
-		},
-		HostedZoneId: aws.String(hzID.s),
 	}
 
-	// update the dns records in route53
-	_, err := r53svc.ChangeResourceRecordSets(params)
+	if err := u53.flushProviders(ctx); err != nil && firstErr == nil {
+		firstErr = err
+	}
 
-	errChan <- err // which may be nil
+	for _, outcome := range pending {
+		if err := u53.commitOutcome(outcome); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
 
-	// save a copy so we do not update every timer tick
-	if u53.verbose {
-		log.Printf("info - updated ip cache. new: %s old: %s\n", publicIP.ip, u53.previousip)
+	u53.recordTick(firstErr == nil)
+
+	errChan <- firstErr // which may be nil
+}
+
+// commitOutcome waits for outcome.done - already resolved by the time
+// updateAll calls this, since flushProviders has just run - and, only if the
+// provider confirms the change was actually applied, updates the ip cache
+// and exported metrics. A zone that fails to flush is left uncommitted so
+// it's retried on the next tick instead of being mistaken for up to date.
+func (u53 *update53) commitOutcome(outcome reconcileOutcome) error {
+
+	if err := <-outcome.done; err != nil {
+		u53.log.Warn("error applying dns update",
+			zap.String("hostname", outcome.hostname),
+			zap.String("type", outcome.rtype),
+			zap.Error(err),
+		)
+		updatesTotal.WithLabelValues("error").Inc()
+		return err
 	}
-	u53.previousip = publicIP.ip
+
+	u53.previousipsMu.Lock()
+	oldIP := u53.previousips[outcome.cacheKey]
+	u53.previousips[outcome.cacheKey] = outcome.ip
+	u53.previousipsMu.Unlock()
+
+	u53.log.Info("updating ip cache",
+		zap.String("hostname", outcome.hostname),
+		zap.String("type", outcome.rtype),
+		zap.String("old_ip", oldIP),
+		zap.String("new_ip", outcome.ip),
+	)
+	setCachedIP(outcome.hostname, outcome.rtype, outcome.ip)
+	updatesTotal.WithLabelValues("ok").Inc()
+
+	return nil
 }
 
-// getHostedZoneId gets the data from AWS so route53 can be updated
-func getHostedZoneID(r53svc *route53.Route53, hostname, hz string) chan *futureAns {
+// flushProviders calls Flush on every provider used so far that implements
+// batchFlusher, once all of this tick's entries have been reconciled. This is
+// what lets route53Provider fold every entry destined for the same hosted
+// zone into a single ChangeResourceRecordSets call instead of one per entry.
+func (u53 *update53) flushProviders(ctx context.Context) error {
+
+	u53.providersMu.Lock()
+	names := make([]string, 0, len(u53.providers))
+	providers := make([]Provider, 0, len(u53.providers))
+	for name, p := range u53.providers {
+		names = append(names, name)
+		providers = append(providers, p)
+	}
+	u53.providersMu.Unlock()
 
-	c := make(chan *futureAns)
+	var firstErr error
+	for i, p := range providers {
+		bf, ok := p.(batchFlusher)
+		if !ok {
+			continue
+		}
 
-	go func() {
-		defer close(c)
-		// if we are supplied with a hosted zone id then just return that in the channel
-		if hz != "" {
-			c <- &futureAns{s: hz, e: nil}
-			return
+		start := time.Now()
+		err := bf.Flush(ctx)
+		result := "ok"
+		if err != nil {
+			result = "error"
 		}
+		providerCallLatency.WithLabelValues(names[i], result).Observe(time.Since(start).Seconds())
 
-		// get a list of all hosted zones and get the hostedzoneid
-		resp, err := r53svc.ListHostedZones(&route53.ListHostedZonesInput{})
 		if err != nil {
-			c <- &futureAns{s: "", e: err}
-			return
+			u53.log.Warn("error flushing batched changes", zap.String("provider", names[i]), zap.Error(err))
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
+	}
 
-		var hzid *string
+	return firstErr
+}
 
-		// search the hosted zones till we find the zone for the hostname
-		// FIXME - max items = 100 so need to handle big lists
-		for _, hz := range resp.HostedZones {
+// reconcileOutcome is what reconcileEntry hands back to updateAll for an
+// entry whose record needs updating. done resolves once the provider
+// confirms the change was actually applied: immediately for a provider that
+// talks to its backend inline, or only once updateAll calls flushProviders
+// for a batchFlusher provider queuing changes for the same hosted zone. A
+// zero-value reconcileOutcome (done == nil) means there is nothing to
+// commit, either because the entry failed earlier or its ip had not changed.
+type reconcileOutcome struct {
+	cacheKey string
+	hostname string
+	rtype    string
+	ip       string
+	done     <-chan error
+}
 
-			if strings.HasSuffix(hostname, *hz.Name) {
-				// we found the hosted zone so use the id
-				hzid = hz.Id
-				break
-			}
+// reconcileEntry works out the current public ip for a single config entry
+// and, if it differs from the cached previous ip, upserts it via the entry's
+// provider. It does not itself update the ip cache, the "ok" update count or
+// the cached ip gauge for a changed entry - see reconcileOutcome - so that
+// those are only committed once the provider confirms the change was
+// applied. It does record the Upsert call's latency, and counts an error for
+// an entry that fails before that point.
+func (u53 *update53) reconcileEntry(ctx context.Context, entry ConfigEntry) (reconcileOutcome, error) {
+
+	if entry.Hostname == "" {
+		updatesTotal.WithLabelValues("error").Inc()
+		return reconcileOutcome{}, errors.New("invalid hostname supplied")
+	}
+
+	hostname := entry.Hostname
+	if !strings.HasSuffix(hostname, ".") {
+		hostname = hostname + "."
+	}
+
+	if entry.ForceIP != "" {
+		if x := net.ParseIP(entry.ForceIP); x == nil {
+			updatesTotal.WithLabelValues("error").Inc()
+			return reconcileOutcome{}, fmt.Errorf("invalid force ip supplied: %s", entry.ForceIP)
 		}
+	}
+
+	rtype := entry.Type
+	if rtype == "" {
+		rtype = "A"
+	}
+	ipv6 := rtype == "AAAA"
+
+	// fill the channel with the future answer to our question
+	ipChan := GetPublicIP(ctx, u53.log, entry.ForceIP, entry.GetIP, entry.Iface, ipv6, u53.allowPrivate)
 
-		if hzid == nil {
-			c <- &futureAns{s: "", e: errors.New("unable to find hosted domain details")}
+	// block until the answer becomes available
+	publicIP := <-ipChan
+
+	if publicIP.e != nil {
+		updatesTotal.WithLabelValues("error").Inc()
+		return reconcileOutcome{}, publicIP.e
+	}
+
+	// cache the previous ip per (hostname, type) so a dual-stack host can
+	// maintain both an A and an AAAA record without them fighting each other
+	cacheKey := hostname + "|" + rtype
+
+	u53.previousipsMu.Lock()
+	unchanged := u53.previousips[cacheKey] == publicIP.ip
+	u53.previousipsMu.Unlock()
+
+	if unchanged {
+		// ip has not changed so no need to do anything else
+		u53.log.Debug("public ip has not changed so not updating", zap.String("hostname", hostname), zap.String("type", rtype))
+		updatesTotal.WithLabelValues("nochange").Inc()
+		return reconcileOutcome{}, nil
+	}
+
+	provider, err := u53.providerFor(ctx, entry.Provider)
+	if err != nil {
+		updatesTotal.WithLabelValues("error").Inc()
+		return reconcileOutcome{}, err
+	}
+
+	providerName := entry.Provider
+	if providerName == "" {
+		providerName = u53.providerName
+	}
+
+	ttl := entry.TTL
+	if ttl == 0 {
+		ttl = 300
+	}
+
+	start := time.Now()
+	var done <-chan error
+	if entry.HostedZone != "" {
+		if zh, ok := provider.(zoneHinter); ok {
+			done, err = zh.UpsertInZone(ctx, entry.HostedZone, hostname, rtype, publicIP.ip, ttl)
 		} else {
-			c <- &futureAns{s: *hzid, e: nil}
+			done, err = provider.Upsert(ctx, hostname, rtype, publicIP.ip, ttl)
 		}
-	}()
-	return c
+	} else {
+		done, err = provider.Upsert(ctx, hostname, rtype, publicIP.ip, ttl)
+	}
+	latencyResult := "ok"
+	if err != nil {
+		latencyResult = "error"
+	}
+	providerCallLatency.WithLabelValues(providerName, latencyResult).Observe(time.Since(start).Seconds())
+	if err != nil {
+		updatesTotal.WithLabelValues("error").Inc()
+		return reconcileOutcome{}, err
+	}
+
+	return reconcileOutcome{
+		cacheKey: cacheKey,
+		hostname: hostname,
+		rtype:    rtype,
+		ip:       publicIP.ip,
+		done:     done,
+	}, nil
 }
 
 /*